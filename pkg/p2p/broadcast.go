@@ -0,0 +1,194 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// defaultBroadcastConcurrency bounds how many peers a single Broadcast or
+// SendToMany call sends to at once, unless overridden with
+// WithBroadcastConcurrency.
+const defaultBroadcastConcurrency = 16
+
+// BroadcastMode controls how many of the targeted peers must successfully
+// receive a message for Broadcast or SendToMany to report success. Per-peer
+// errors are always returned in the result map regardless of mode.
+type BroadcastMode int
+
+const (
+	// BroadcastBestEffort never fails the call because of per-peer
+	// errors; callers inspect the returned map themselves.
+	BroadcastBestEffort BroadcastMode = iota
+	// BroadcastQuorum requires at least the quorum set by WithQuorum to
+	// succeed.
+	BroadcastQuorum
+	// BroadcastAllMustSucceed requires every targeted peer to succeed.
+	BroadcastAllMustSucceed
+)
+
+// BroadcastOption customizes a single Broadcast or SendToMany call.
+type BroadcastOption func(*broadcastOptions)
+
+type broadcastOptions struct {
+	mode        BroadcastMode
+	quorum      int
+	concurrency int
+}
+
+func defaultBroadcastOptions() broadcastOptions {
+	return broadcastOptions{
+		mode:        BroadcastBestEffort,
+		concurrency: defaultBroadcastConcurrency,
+	}
+}
+
+// WithBroadcastMode sets the success criterion for the call.
+func WithBroadcastMode(mode BroadcastMode) BroadcastOption {
+	return func(o *broadcastOptions) { o.mode = mode }
+}
+
+// WithQuorum sets the number of peers that must succeed when the call uses
+// BroadcastQuorum. It has no effect with other modes.
+func WithQuorum(n int) BroadcastOption {
+	return func(o *broadcastOptions) { o.quorum = n }
+}
+
+// WithBroadcastConcurrency bounds how many peers are sent to concurrently.
+func WithBroadcastConcurrency(n int) BroadcastOption {
+	return func(o *broadcastOptions) { o.concurrency = n }
+}
+
+// errNoLiveClient is recorded in SendToMany's result map for a target that
+// has never connected or is currently backing off after a failure, so that
+// BroadcastAllMustSucceed/BroadcastQuorum cannot be satisfied vacuously by
+// skipping every requested target.
+var errNoLiveClient = errors.New("no live client for this peer")
+
+// Broadcast sends msg on topic to every peer that currently has a live
+// client, skipping peers that have never connected or are backing off
+// after a failure. See SendToMany for the concurrency, deadline, and
+// success-criterion semantics.
+func (m *messageRouterImpl) Broadcast(
+	ctx context.Context, topic string, msg interface{}, opts ...BroadcastOption,
+) (map[NodeID]error, error) {
+	m.mu.RLock()
+	targets := make([]NodeID, 0, len(m.clients))
+	for id := range m.clients {
+		targets = append(targets, id)
+	}
+	m.mu.RUnlock()
+
+	return m.sendToTargets(ctx, targets, topic, msg, opts...)
+}
+
+// SendToMany sends msg on topic to each of targets, and fans the sends out
+// concurrently up to the limit set by WithBroadcastConcurrency
+// (defaultBroadcastConcurrency if unset). ctx's deadline, if any, applies
+// to every individual send. The returned map holds exactly one entry per
+// target, keyed by NodeID; a nil value means the send succeeded, and a
+// target with no currently live client (never connected, or backing off
+// after a failure) fails with errNoLiveClient without being dialed. The
+// returned error is non-nil only if the BroadcastMode's success criterion
+// was not met, and a skipped target always counts against that criterion.
+func (m *messageRouterImpl) SendToMany(
+	ctx context.Context, targets []NodeID, topic string, msg interface{}, opts ...BroadcastOption,
+) (map[NodeID]error, error) {
+	return m.sendToTargets(ctx, targets, topic, msg, opts...)
+}
+
+func (m *messageRouterImpl) sendToTargets(
+	ctx context.Context, targets []NodeID, topic string, msg interface{}, opts ...BroadcastOption,
+) (map[NodeID]error, error) {
+	options := defaultBroadcastOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.concurrency <= 0 {
+		// An unbuffered sem would deadlock the loop below: nothing ever
+		// reads from it before the first send is queued.
+		options.concurrency = defaultBroadcastConcurrency
+	}
+
+	var (
+		mu      sync.Mutex
+		results = make(map[NodeID]error, len(targets))
+		sem     = make(chan struct{}, options.concurrency)
+		wg      sync.WaitGroup
+	)
+	for _, target := range targets {
+		m.mu.RLock()
+		cliWrapper, ok := m.clients[target]
+		m.mu.RUnlock()
+		if !ok {
+			// No live client for this peer right now; record it as a
+			// failure rather than dialing or reviving it via GetClient
+			// (a broadcast must never mutate the reconnect state
+			// machine), and rather than silently excluding it, so that
+			// BroadcastAllMustSucceed/BroadcastQuorum cannot pass
+			// vacuously by skipping every requested target.
+			mu.Lock()
+			results[target] = errNoLiveClient
+			mu.Unlock()
+			continue
+		}
+		client := cliWrapper.MessageClient
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(target NodeID, client MessageClient) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			_, err := client.SendMessage(ctx, topic, msg)
+			mu.Lock()
+			results[target] = err
+			mu.Unlock()
+
+			if err != nil {
+				log.Warn("failed to send message to peer",
+					zap.String("target", target), zap.String("topic", topic), zap.Error(err))
+			}
+		}(target, client)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for _, err := range results {
+		if err == nil {
+			succeeded++
+		}
+	}
+	log.Info("broadcast message delivered",
+		zap.String("topic", topic),
+		zap.Int("targets", len(targets)),
+		zap.Int("succeeded", succeeded))
+
+	switch options.mode {
+	case BroadcastAllMustSucceed:
+		if succeeded < len(targets) {
+			return results, errors.Errorf("broadcast on topic %q only succeeded for %d/%d targets", topic, succeeded, len(targets))
+		}
+	case BroadcastQuorum:
+		if succeeded < options.quorum {
+			return results, errors.Errorf("broadcast on topic %q only succeeded for %d/%d targets, need %d", topic, succeeded, len(targets), options.quorum)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/pkg/security"
+	"go.uber.org/zap"
+)
+
+// grpcConnectGracePeriod is how long run waits, after starting the gRPC
+// client's Run, before treating the connection as up. The gRPC
+// MessageClient does not yet expose a "stream is up" signal or perform an
+// on-stream capability exchange, so this is a best-effort stand-in: a
+// failed dial or an immediately-broken stream almost always surfaces well
+// within this window, which is enough to stop reporting a peer as
+// Connected when it never actually came up.
+const grpcConnectGracePeriod = 2 * time.Second
+
+// ClientFactory is the extension point that lets a peer address scheme map
+// to a transport other than gRPC, such as a shared message broker. It is
+// resolved by messageRouterImpl from the scheme of the peer's PeerAddress,
+// the same way TransportDialer is.
+type ClientFactory interface {
+	// NewClient constructs a MessageClient for target and returns a run
+	// function that starts the underlying transport. run has the same
+	// blocking contract as the gRPC MessageClient's Run method today: it
+	// blocks until ctx is canceled or the connection fails, and its
+	// return value drives messageRouterImpl's reconnect state machine.
+	// NewClient itself must not block.
+	//
+	// run must invoke exactly one of onConnected or onHandshake once the
+	// connection is confirmed up, before doing anything else: onConnected
+	// if the transport does not negotiate PeerCapabilities with the peer,
+	// or onHandshake with the peer's advertised capabilities if it does.
+	// Only a transport that calls onHandshake causes its peer to be
+	// reported by Capabilities and considered by RouteTopic; one that
+	// only ever calls onConnected is still dialed, reconnected and
+	// broadcast to like any other peer, but is invisible to topic-based
+	// routing, since nothing was actually negotiated with it. A
+	// handshake failure (incompatible version, missing required feature)
+	// must be returned wrapped with newHandshakeError, so that it is
+	// treated as a terminal failure instead of retried.
+	NewClient(selfID, target NodeID, config *MessageClientConfig) (
+		client MessageClient,
+		run func(ctx context.Context, addr PeerAddress, credential *security.Credential, local PeerCapabilities, onConnected func(), onHandshake func(PeerCapabilities)) error,
+	)
+}
+
+var (
+	clientFactoryMu sync.RWMutex
+	clientFactories = map[string]ClientFactory{}
+)
+
+// RegisterClientFactory registers the ClientFactory used for peers whose
+// address has the given URL scheme. It is expected to be called from
+// package init functions. Registering the same scheme twice panics.
+func RegisterClientFactory(scheme string, factory ClientFactory) {
+	clientFactoryMu.Lock()
+	defer clientFactoryMu.Unlock()
+
+	if _, ok := clientFactories[scheme]; ok {
+		log.Panic("client factory already registered", zap.String("scheme", scheme))
+	}
+	clientFactories[scheme] = factory
+}
+
+func lookupClientFactory(scheme string) (ClientFactory, bool) {
+	clientFactoryMu.RLock()
+	defer clientFactoryMu.RUnlock()
+
+	factory, ok := clientFactories[scheme]
+	return factory, ok
+}
+
+func hasClientFactory(scheme string) bool {
+	_, ok := lookupClientFactory(scheme)
+	return ok
+}
+
+// grpcClientFactory is the default ClientFactory, used for every scheme
+// that dials a peer directly over gRPC: "grpc", "unix", "tls" and "mtls".
+type grpcClientFactory struct{}
+
+// NewClient implements ClientFactory.
+//
+// gRPC does not yet perform any on-stream PeerCapabilities exchange, so
+// run only ever calls onConnected, never onHandshake: claiming a
+// capability negotiation that did not happen would make Capabilities
+// report fabricated data and RouteTopic silently route to nobody (every
+// gRPC peer would advertise no Topics). Until a real on-stream exchange
+// is implemented in the gRPC MessageClient itself, callers that need
+// per-topic routing must keep targeting gRPC peers directly rather than
+// through RouteTopic.
+func (grpcClientFactory) NewClient(
+	selfID, target NodeID, config *MessageClientConfig,
+) (
+	MessageClient,
+	func(ctx context.Context, addr PeerAddress, credential *security.Credential, local PeerCapabilities, onConnected func(), onHandshake func(PeerCapabilities)) error,
+) {
+	client := NewGrpcMessageClient(selfID, config)
+	run := func(
+		ctx context.Context, addr PeerAddress, credential *security.Credential,
+		_ PeerCapabilities, onConnected func(), _ func(PeerCapabilities),
+	) error {
+		dialer, err := addr.Dialer(credential)
+		if err != nil {
+			return err
+		}
+
+		runErrCh := make(chan error, 1)
+		go func() {
+			runErrCh <- client.Run(ctx, dialer.Network(), dialer.Target(), target, dialer.Credential())
+		}()
+
+		// Wait out grpcConnectGracePeriod before calling onConnected, so a
+		// dial that fails immediately (bad address, connection refused)
+		// never fires PeerEventConnected for a peer that was never
+		// actually reachable.
+		select {
+		case err := <-runErrCh:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(grpcConnectGracePeriod):
+			onConnected()
+		}
+
+		return <-runErrCh
+	}
+	return client, run
+}
+
+func init() {
+	factory := grpcClientFactory{}
+	RegisterClientFactory("grpc", factory)
+	RegisterClientFactory("unix", factory)
+	RegisterClientFactory("tls", factory)
+	RegisterClientFactory("mtls", factory)
+}
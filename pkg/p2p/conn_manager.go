@@ -0,0 +1,275 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// PeerConnState describes the lifecycle state of a peer connection as
+// tracked by messageRouterImpl.
+type PeerConnState int32
+
+const (
+	// PeerStateIdle means no connection attempt has been made yet.
+	PeerStateIdle PeerConnState = iota
+	// PeerStateConnecting means a dial is currently in flight.
+	PeerStateConnecting
+	// PeerStateConnected means the client is currently streaming.
+	PeerStateConnected
+	// PeerStateBackoff means the previous attempt failed and a retry has
+	// been scheduled.
+	PeerStateBackoff
+	// PeerStateFailed means the peer's retry budget has been exhausted
+	// (transient peers only) and no further attempts will be made.
+	PeerStateFailed
+)
+
+// String implements fmt.Stringer.
+func (s PeerConnState) String() string {
+	switch s {
+	case PeerStateIdle:
+		return "idle"
+	case PeerStateConnecting:
+		return "connecting"
+	case PeerStateConnected:
+		return "connected"
+	case PeerStateBackoff:
+		return "backoff"
+	case PeerStateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEventType enumerates the kinds of events delivered on a
+// MessageRouter's Subscribe channel.
+type PeerEventType int
+
+const (
+	// PeerEventConnected is emitted when a client successfully starts
+	// streaming to a peer.
+	PeerEventConnected PeerEventType = iota
+	// PeerEventDisconnected is emitted whenever a client exits, including
+	// one that never connected, and whether or not a retry follows.
+	PeerEventDisconnected
+	// PeerEventBackoff is emitted when a reconnect attempt is scheduled
+	// after a failure.
+	PeerEventBackoff
+)
+
+// PeerEvent describes a change in a peer's connection state.
+type PeerEvent struct {
+	PeerID NodeID
+	Type   PeerEventType
+	Err    error
+}
+
+// BackoffConfig configures the exponential backoff used to space out
+// reconnect attempts to a peer.
+type BackoffConfig struct {
+	// MinRetryDelay is the delay before the first retry.
+	MinRetryDelay time.Duration
+	// MaxRetryDelay caps the delay between retries.
+	MaxRetryDelay time.Duration
+	// Multiplier is applied to the previous delay after each failed
+	// attempt.
+	Multiplier float64
+	// Jitter is the fraction (0 to 1) of the computed delay that is
+	// randomized, to avoid reconnect storms across many peers at once.
+	Jitter float64
+}
+
+// DefaultBackoffConfig is used by AddPeer when no BackoffConfig is given.
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: time.Minute,
+		Multiplier:    2.0,
+		Jitter:        0.2,
+	}
+}
+
+func (c BackoffConfig) delay(retryCount int) time.Duration {
+	d := float64(c.MinRetryDelay)
+	for i := 0; i < retryCount; i++ {
+		d *= c.Multiplier
+	}
+	if capped := float64(c.MaxRetryDelay); d > capped {
+		d = capped
+	}
+	if c.Jitter > 0 {
+		d += d * c.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+type peerConnOptions struct {
+	persistent bool
+	maxRetries int // 0 means unlimited; only meaningful when !persistent
+	backoff    BackoffConfig
+}
+
+// AddPeerOption customizes how AddPeer manages a peer's connection.
+type AddPeerOption func(*peerConnOptions)
+
+// WithPersistent marks the peer as persistent: the router keeps retrying
+// with backoff forever instead of giving up once the retry budget set by
+// WithMaxRetries is exhausted.
+func WithPersistent() AddPeerOption {
+	return func(o *peerConnOptions) {
+		o.persistent = true
+	}
+}
+
+// WithMaxRetries bounds the number of reconnect attempts made for a
+// transient peer before it is marked PeerStateFailed. It has no effect on
+// a peer added with WithPersistent. The default is unlimited.
+func WithMaxRetries(n int) AddPeerOption {
+	return func(o *peerConnOptions) {
+		o.maxRetries = n
+	}
+}
+
+// WithBackoffConfig overrides DefaultBackoffConfig for a single peer.
+func WithBackoffConfig(cfg BackoffConfig) AddPeerOption {
+	return func(o *peerConnOptions) {
+		o.backoff = cfg
+	}
+}
+
+// peerConn tracks the reconnect state machine for a single peer. It is
+// owned by messageRouterImpl and guarded by its own mutex so that readers
+// of PeerState do not contend with messageRouterImpl.mu.
+type peerConn struct {
+	id   NodeID
+	addr PeerAddress
+	opts peerConnOptions
+
+	// stopCh is closed by RemovePeer to cancel an in-progress backoff wait.
+	stopCh chan struct{}
+
+	mu          sync.Mutex
+	state       PeerConnState
+	lastErr     error
+	retryCount  int
+	nextAttempt time.Time
+}
+
+func newPeerConn(id NodeID, addr PeerAddress, opts peerConnOptions) *peerConn {
+	return &peerConn{
+		id:     id,
+		addr:   addr,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+		state:  PeerStateIdle,
+	}
+}
+
+func (p *peerConn) snapshot() (PeerConnState, error, time.Time, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state, p.lastErr, p.nextAttempt, p.retryCount
+}
+
+func (p *peerConn) setConnecting() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = PeerStateConnecting
+}
+
+func (p *peerConn) setConnected() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state = PeerStateConnected
+	p.retryCount = 0
+	p.lastErr = nil
+}
+
+// setIncompatible marks the peer as permanently failed following a
+// handshake error, bypassing the usual retry budget: a handshake failure
+// (incompatible version, missing required feature) would only repeat on
+// retry, so there is nothing to back off and retry towards.
+func (p *peerConn) setIncompatible(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	p.state = PeerStateFailed
+}
+
+// setBackingOff records a failed attempt and returns the delay to wait
+// before retrying. ok is false if the peer's retry budget is exhausted, in
+// which case the peer transitions to PeerStateFailed instead.
+func (p *peerConn) setBackingOff(err error) (delay time.Duration, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastErr = err
+	p.retryCount++
+	if !p.opts.persistent && p.opts.maxRetries > 0 && p.retryCount > p.opts.maxRetries {
+		p.state = PeerStateFailed
+		return 0, false
+	}
+	delay = p.opts.backoff.delay(p.retryCount - 1)
+	p.state = PeerStateBackoff
+	p.nextAttempt = time.Now().Add(delay)
+	return delay, true
+}
+
+// peerEventBufferSize is the capacity of channels returned by Subscribe.
+// Events are dropped, never blocked on, once a subscriber falls behind.
+const peerEventBufferSize = 64
+
+// PeerState returns the current connection state of a peer previously
+// passed to AddPeer. The zero state (PeerStateIdle) and a nil error are
+// returned for peers unknown to the router.
+func (m *messageRouterImpl) PeerState(id NodeID) (state PeerConnState, lastErr error, nextAttempt time.Time, retryCount int) {
+	m.mu.RLock()
+	pc, ok := m.peers[id]
+	m.mu.RUnlock()
+	if !ok {
+		return PeerStateIdle, nil, time.Time{}, 0
+	}
+	return pc.snapshot()
+}
+
+// Subscribe returns a channel on which PeerEvents are delivered as peers
+// connect, disconnect, and enter backoff. The channel is never closed by
+// the router; callers should stop reading once they no longer need events.
+func (m *messageRouterImpl) Subscribe() <-chan PeerEvent {
+	ch := make(chan PeerEvent, peerEventBufferSize)
+	m.mu.Lock()
+	m.subscribers = append(m.subscribers, ch)
+	m.mu.Unlock()
+	return ch
+}
+
+func (m *messageRouterImpl) emitEvent(ev PeerEvent) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, ch := range m.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// The subscriber is falling behind; drop the event rather
+			// than block the connection manager.
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoffConfigDelay(t *testing.T) {
+	cfg := BackoffConfig{
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: 10 * time.Second,
+		Multiplier:    2.0,
+		Jitter:        0,
+	}
+
+	cases := []struct {
+		retryCount int
+		want       time.Duration
+	}{
+		{retryCount: 0, want: time.Second},
+		{retryCount: 1, want: 2 * time.Second},
+		{retryCount: 2, want: 4 * time.Second},
+		{retryCount: 10, want: 10 * time.Second}, // capped by MaxRetryDelay
+	}
+	for _, tc := range cases {
+		if got := cfg.delay(tc.retryCount); got != tc.want {
+			t.Errorf("delay(%d) = %v, want %v", tc.retryCount, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffConfigDelayJitterBounds(t *testing.T) {
+	cfg := BackoffConfig{
+		MinRetryDelay: time.Second,
+		MaxRetryDelay: 10 * time.Second,
+		Multiplier:    2.0,
+		Jitter:        0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		d := cfg.delay(5)
+		if d < 0 {
+			t.Fatalf("delay() = %v, want >= 0", d)
+		}
+		if d > cfg.MaxRetryDelay+time.Duration(float64(cfg.MaxRetryDelay)*cfg.Jitter) {
+			t.Fatalf("delay() = %v, exceeds MaxRetryDelay plus jitter", d)
+		}
+	}
+}
+
+func TestPeerConnRetryBudgetExhausted(t *testing.T) {
+	pc := newPeerConn("target", PeerAddress{Scheme: "grpc", Host: "127.0.0.1:1"}, peerConnOptions{
+		maxRetries: 2,
+		backoff:    DefaultBackoffConfig(),
+	})
+
+	_, ok := pc.setBackingOff(errors.New("dial failed"))
+	if !ok {
+		t.Fatalf("setBackingOff should still allow retries within the budget")
+	}
+	if state, _, _, _ := pc.snapshot(); state != PeerStateBackoff {
+		t.Fatalf("state = %v, want %v", state, PeerStateBackoff)
+	}
+
+	_, ok = pc.setBackingOff(errors.New("dial failed"))
+	if !ok {
+		t.Fatalf("setBackingOff should still allow retries within the budget")
+	}
+
+	_, ok = pc.setBackingOff(errors.New("dial failed"))
+	if ok {
+		t.Fatalf("setBackingOff should report the retry budget as exhausted")
+	}
+	state, _, _, retryCount := pc.snapshot()
+	if state != PeerStateFailed {
+		t.Fatalf("state = %v, want %v", state, PeerStateFailed)
+	}
+	if retryCount != 3 {
+		t.Fatalf("retryCount = %d, want 3", retryCount)
+	}
+}
+
+func TestPeerConnPersistentNeverFails(t *testing.T) {
+	pc := newPeerConn("target", PeerAddress{Scheme: "grpc", Host: "127.0.0.1:1"}, peerConnOptions{
+		persistent: true,
+		maxRetries: 1,
+		backoff:    DefaultBackoffConfig(),
+	})
+
+	for i := 0; i < 5; i++ {
+		if _, ok := pc.setBackingOff(errors.New("dial failed")); !ok {
+			t.Fatalf("persistent peer should never exhaust its retry budget")
+		}
+	}
+	if state, _, _, _ := pc.snapshot(); state != PeerStateBackoff {
+		t.Fatalf("state = %v, want %v", state, PeerStateBackoff)
+	}
+}
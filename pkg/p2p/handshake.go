@@ -0,0 +1,151 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// minSupportedProtocolVersion is the oldest PeerCapabilities.ProtocolVersion
+// this node will accept a connection from.
+const minSupportedProtocolVersion = 1
+
+// localProtocolVersion is advertised to peers in our own PeerCapabilities.
+const localProtocolVersion = 1
+
+// PeerCapabilities is exchanged between two nodes once their connection is
+// established, so each side knows what the other supports. This mirrors
+// the capability exchange used by the go-ethereum LES peer implementation,
+// and lets a cluster run with mixed versions during a rolling upgrade.
+// Only the broker-backed ClientFactory performs this exchange, and its
+// SendMessage already accepts application messages before the handshake
+// completes; gRPC peers do not exchange PeerCapabilities at all.
+type PeerCapabilities struct {
+	// ProtocolVersion is the p2p wire protocol version the peer speaks.
+	ProtocolVersion int
+	// Topics lists the topic prefixes the peer is willing to receive
+	// messages for; see PeerCapabilities.SupportsTopic and RouteTopic.
+	Topics []string
+	// MaxMessageSize is the largest message, in bytes, the peer accepts.
+	MaxMessageSize int
+	// CompressionCodecs lists the compression codecs the peer can decode,
+	// in the peer's order of preference.
+	CompressionCodecs []string
+	// Features holds arbitrary feature flags, for capabilities that don't
+	// warrant a dedicated field or a protocol version bump.
+	Features map[string]string
+}
+
+// SupportsTopic reports whether caps advertises support for a message on
+// the given topic, i.e. whether topic has one of caps.Topics as a prefix.
+func (caps PeerCapabilities) SupportsTopic(topic string) bool {
+	for _, prefix := range caps.Topics {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	requiredFeaturesMu sync.RWMutex
+	requiredFeatures   []string
+)
+
+// RequireFeature marks a feature flag as mandatory for every peer: a peer
+// whose handshake does not advertise it fails the handshake and is treated
+// as a terminal failure rather than retried.
+func RequireFeature(feature string) {
+	requiredFeaturesMu.Lock()
+	defer requiredFeaturesMu.Unlock()
+	requiredFeatures = append(requiredFeatures, feature)
+}
+
+// checkCompatible validates a peer's advertised capabilities against this
+// node's minimum protocol version and required features.
+func checkCompatible(caps PeerCapabilities) error {
+	if caps.ProtocolVersion < minSupportedProtocolVersion {
+		return fmt.Errorf("peer protocol version %d is older than the minimum supported version %d",
+			caps.ProtocolVersion, minSupportedProtocolVersion)
+	}
+	requiredFeaturesMu.RLock()
+	defer requiredFeaturesMu.RUnlock()
+	for _, feature := range requiredFeatures {
+		if _, ok := caps.Features[feature]; !ok {
+			return fmt.Errorf("peer is missing required feature %q", feature)
+		}
+	}
+	return nil
+}
+
+// handshakeError wraps a handshake failure (incompatible version, missing
+// required feature) so that runClient can tell it apart from an ordinary
+// connection error: a handshake failure is a terminal failure for the
+// peer and is never retried, since retrying would only repeat the same
+// incompatibility.
+type handshakeError struct {
+	cause error
+}
+
+func newHandshakeError(cause error) error {
+	return &handshakeError{cause: cause}
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("p2p handshake failed: %s", e.cause)
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.cause
+}
+
+func isHandshakeError(err error) bool {
+	var he *handshakeError
+	return errors.As(err, &he)
+}
+
+// Capabilities returns the PeerCapabilities negotiated with id during its
+// handshake. It returns false if id has never completed a handshake,
+// including while its connection is being (re)established, and for any
+// peer whose ClientFactory does not negotiate capabilities at all (gRPC,
+// currently) rather than fabricating a value for it.
+func (m *messageRouterImpl) Capabilities(id NodeID) (PeerCapabilities, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	caps, ok := m.peerCaps[id]
+	return caps, ok
+}
+
+// RouteTopic returns the peers that have both completed a handshake and
+// advertised support for topic, so that callers stop sending messages to
+// peers that cannot handle them, e.g. during a rolling upgrade. A peer
+// connected through a ClientFactory that does not negotiate capabilities
+// at all (gRPC, currently) is never returned, since nothing was actually
+// negotiated with it; callers that need to reach such peers must target
+// them directly instead of through RouteTopic.
+func (m *messageRouterImpl) RouteTopic(topic string) []NodeID {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	targets := make([]NodeID, 0, len(m.peerCaps))
+	for id, caps := range m.peerCaps {
+		if caps.SupportsTopic(topic) {
+			targets = append(targets, id)
+		}
+	}
+	return targets
+}
@@ -16,6 +16,7 @@ package p2p
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
@@ -27,8 +28,21 @@ import (
 // MessageRouter is used to maintain clients to all the peers in the cluster
 // that the local node needs to communicate with.
 type MessageRouter interface {
-	// AddPeer should be invoked when a new peer is discovered.
-	AddPeer(id NodeID, addr string)
+	// AddPeer should be invoked when a new peer is discovered. addr is a
+	// URL such as "grpc://host:port", "unix:///var/run/tiflow.sock" or
+	// "tls://host:port"; the scheme selects the ClientFactory (and, for
+	// directly dialed schemes, the TransportDialer) used to reach the peer. A bare "host:port" is rejected: callers that relied
+	// on the old implicit "tcp" network must add a "grpc://" prefix.
+	//
+	// By default a peer is transient: if its client exits with an error,
+	// the router retries with backoff. The default retry budget is
+	// unlimited, the same as a persistent peer; pass WithMaxRetries to
+	// bound it, after which the peer is marked PeerStateFailed instead of
+	// retried further. Pass WithPersistent for peers that are known to be
+	// part of the cluster rather than discovered best-effort: unlike a
+	// transient peer with a bounded WithMaxRetries, it is never marked
+	// PeerStateFailed and always keeps retrying forever.
+	AddPeer(id NodeID, addr string, opts ...AddPeerOption)
 	// RemovePeer should be invoked when a peer is determined to
 	// be permanently unavailable.
 	RemovePeer(id NodeID)
@@ -38,6 +52,38 @@ type MessageRouter interface {
 	GetClient(target NodeID) MessageClient
 	// GetLocalChannel returns a channel that can be used for intra-node communication.
 	GetLocalChannel() <-chan RawMessageEntry
+	// BrokerMessages returns the channel on which target's client delivers
+	// application messages addressed to this node, for a peer added with a
+	// broker-backed address (e.g. "nats://..."). The channel carries
+	// messages from every peer publishing to this node under the same
+	// subject prefix, not only those sent by target. It returns false for
+	// any other peer, including one reached over gRPC directly or one
+	// that does not exist, since those do not have a receive path
+	// distinct from whatever consumes MessageClient.SendMessage's
+	// stream on the gRPC side.
+	BrokerMessages(target NodeID) (<-chan BrokerMessage, bool)
+	// PeerState returns the connection state last observed for a peer
+	// added via AddPeer, along with the error from its last failed
+	// attempt, if any, and when the next attempt (if backing off) is due.
+	PeerState(id NodeID) (state PeerConnState, lastErr error, nextAttempt time.Time, retryCount int)
+	// Subscribe returns a channel on which PeerEvents are delivered as
+	// peers connect, disconnect, and enter backoff.
+	Subscribe() <-chan PeerEvent
+	// Broadcast sends msg on topic to every peer with a currently live
+	// client. See SendToMany for the concurrency and success semantics.
+	Broadcast(ctx context.Context, topic string, msg interface{}, opts ...BroadcastOption) (map[NodeID]error, error)
+	// SendToMany sends msg on topic to each of targets. A target without a
+	// currently live client is not dialed; it gets errNoLiveClient in the
+	// result map and counts against the BroadcastMode's success criterion.
+	SendToMany(ctx context.Context, targets []NodeID, topic string, msg interface{}, opts ...BroadcastOption) (map[NodeID]error, error)
+	// Capabilities returns the PeerCapabilities negotiated with id during
+	// its handshake. It returns false if id has never completed a
+	// handshake, including while its connection is being (re)established.
+	Capabilities(id NodeID) (caps PeerCapabilities, ok bool)
+	// RouteTopic returns the peers that have both completed a handshake
+	// and advertised support for topic, so callers stop sending messages
+	// to peers that cannot handle them, e.g. during a rolling upgrade.
+	RouteTopic(topic string) []NodeID
 	// Close cancels all clients maintained internally and waits for all clients to exit.
 	Close()
 	// Err returns a channel to receive errors from.
@@ -45,9 +91,17 @@ type MessageRouter interface {
 }
 
 type messageRouterImpl struct {
-	mu         sync.RWMutex
-	addressMap map[NodeID]string
-	clients    map[NodeID]clientWrapper
+	mu      sync.RWMutex
+	peers   map[NodeID]*peerConn
+	clients map[NodeID]clientWrapper
+
+	subscribers []chan PeerEvent
+
+	// peerCaps holds the PeerCapabilities negotiated with each peer that
+	// has completed a handshake. An entry is removed when its client
+	// disconnects, so that RouteTopic never targets a peer that is not
+	// currently reachable.
+	peerCaps map[NodeID]PeerCapabilities
 
 	wg       sync.WaitGroup
 	isClosed atomic.Bool
@@ -57,6 +111,7 @@ type messageRouterImpl struct {
 	credentials  *security.Credential
 	selfID       NodeID
 	clientConfig *MessageClientConfig
+	capabilities PeerCapabilities
 
 	enableLocalClient bool
 }
@@ -78,27 +133,71 @@ func newMessageRouterWithLocalClient(
 	enableLocalClient bool,
 ) *messageRouterImpl {
 	return &messageRouterImpl{
-		addressMap:        make(map[NodeID]string),
+		peers:             make(map[NodeID]*peerConn),
 		clients:           make(map[NodeID]clientWrapper),
+		peerCaps:          make(map[NodeID]PeerCapabilities),
 		errCh:             make(chan error, 1), // one error at most
 		credentials:       credentials,
 		selfID:            selfID,
 		clientConfig:      clientConfig,
+		capabilities:      PeerCapabilities{ProtocolVersion: localProtocolVersion},
 		enableLocalClient: enableLocalClient,
 	}
 }
 
+// SetCapabilities overrides the PeerCapabilities this node advertises to
+// peers during the handshake. It must be called, if at all, before the
+// first AddPeer, since it is not retroactively re-negotiated with peers
+// that have already connected.
+func (m *messageRouterImpl) SetCapabilities(caps PeerCapabilities) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.capabilities = caps
+}
+
 type clientWrapper struct {
 	MessageClient
 	cancelFn context.CancelFunc
 }
 
 // AddPeer implements MessageRouter.
-func (m *messageRouterImpl) AddPeer(id NodeID, addr string) {
+func (m *messageRouterImpl) AddPeer(id NodeID, addr string, opts ...AddPeerOption) {
+	peerAddr, err := ParsePeerAddress(addr)
+	if err != nil {
+		log.Warn("failed to add peer, invalid address",
+			zap.String("target", id),
+			zap.String("addr", addr),
+			zap.Error(err))
+		return
+	}
+
+	options := peerConnOptions{backoff: DefaultBackoffConfig()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	pc := newPeerConn(id, peerAddr, options)
+
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	if old, ok := m.peers[id]; ok {
+		close(old.stopCh)
+	}
+	// Cancel any client already connected under the old address; otherwise
+	// it lingers in m.clients and ensureConnected's "already exists" fast
+	// path would treat the new peerConn as connected without ever dialing
+	// the updated address.
+	if oldClient, ok := m.clients[id]; ok {
+		oldClient.cancelFn()
+		delete(m.clients, id)
+	}
+	m.peers[id] = pc
+	m.mu.Unlock()
 
-	m.addressMap[id] = addr
+	if options.persistent {
+		// Persistent peers are dialed eagerly and kept connected by the
+		// router itself; transient peers are only dialed lazily, the
+		// first time GetClient is called for them.
+		m.ensureConnected(id, pc)
+	}
 }
 
 // RemovePeer implements MessageRouter.
@@ -106,7 +205,10 @@ func (m *messageRouterImpl) RemovePeer(id NodeID) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.addressMap, id)
+	if pc, ok := m.peers[id]; ok {
+		close(pc.stopCh)
+		delete(m.peers, id)
+	}
 	// The client is removed from m.clients only after it is successfully
 	// canceled, to prevent duplicate clients to the same target.
 	if clientWrapper, ok := m.clients[id]; ok {
@@ -126,8 +228,19 @@ func (m *messageRouterImpl) GetLocalChannel() <-chan RawMessageEntry {
 	return c.localCh
 }
 
-// GetClient implements MessageRouter. The client will be created lazily.
-// It returns nil if the target peer does not exist.
+// BrokerMessages implements MessageRouter.
+func (m *messageRouterImpl) BrokerMessages(target NodeID) (<-chan BrokerMessage, bool) {
+	client := m.GetClient(target)
+	brokerClient, ok := client.(*brokerMessageClient)
+	if !ok {
+		return nil, false
+	}
+	return brokerClient.Messages(), true
+}
+
+// GetClient implements MessageRouter. The client will be created lazily for
+// a peer that has not been connected yet. It returns nil if the target peer
+// has not been added, or if its retry budget has already been exhausted.
 func (m *messageRouterImpl) GetClient(target NodeID) MessageClient {
 	m.mu.RLock()
 	// fast path
@@ -135,71 +248,164 @@ func (m *messageRouterImpl) GetClient(target NodeID) MessageClient {
 		m.mu.RUnlock()
 		return cliWrapper.MessageClient
 	}
-
-	// There is no ready-to-use client for target
 	m.mu.RUnlock()
-	// escalate the lock
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	// repeats the logic in fast path after escalating the lock, since
-	// the lock was briefly released.
-	if cliWrapper, ok := m.clients[target]; ok {
-		return cliWrapper.MessageClient
-	}
 
-	var cliWrapper clientWrapper
 	if m.enableLocalClient && target == m.selfID {
-		ctx, cancel := context.WithCancel(context.Background())
-		cliWrapper = clientWrapper{
-			MessageClient: newLocalMessageClient(ctx, m.clientConfig),
-			cancelFn:      cancel,
-		}
-	} else {
-		addr, ok := m.addressMap[target]
-		if !ok {
-			log.Warn("failed to create client, no peer",
-				zap.String("target", target),
-				zap.StackSkip("stack", 1))
-			// There is no address for this target. We are not able to create a client.
-			// The client is expected to retry if the target peer is added later.
-			return nil
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// repeats the fast path after escalating the lock, since the
+		// lock was briefly released.
+		if cliWrapper, ok := m.clients[target]; ok {
+			return cliWrapper.MessageClient
 		}
 		ctx, cancel := context.WithCancel(context.Background())
-		client := NewGrpcMessageClient(m.selfID, m.clientConfig)
-		cliWrapper = clientWrapper{
-			MessageClient: client,
+		cliWrapper := clientWrapper{
+			MessageClient: newLocalMessageClient(ctx, m.clientConfig),
 			cancelFn:      cancel,
 		}
-		m.wg.Add(1)
-		go func() {
-			defer m.wg.Done()
-			defer cancel()
-			err := client.Run(ctx, "tcp", addr, target, m.credentials)
-			log.Warn("p2p client exited with error",
-				zap.String("addr", addr),
-				zap.String("targetCapture", target),
-				zap.Error(err))
-
-			if errors.Cause(err) != context.Canceled {
-				// Send the error to the error channel.
-				select {
-				case m.errCh <- err:
-				default:
-					// We allow an error to be lost in case the channel is full.
-				}
-			}
-
-			m.mu.Lock()
-			defer m.mu.Unlock()
-			delete(m.clients, target)
-		}()
-	}
-
-	m.clients[target] = cliWrapper
+		m.clients[target] = cliWrapper
+		return cliWrapper.MessageClient
+	}
+
+	m.mu.RLock()
+	pc, ok := m.peers[target]
+	m.mu.RUnlock()
+	if !ok {
+		log.Warn("failed to create client, no peer",
+			zap.String("target", target),
+			zap.StackSkip("stack", 1))
+		// There is no address for this target. We are not able to create a client.
+		// The client is expected to retry if the target peer is added later.
+		return nil
+	}
+
+	m.ensureConnected(target, pc)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cliWrapper, ok := m.clients[target]
+	if !ok {
+		return nil
+	}
 	return cliWrapper.MessageClient
 }
 
+// ensureConnected starts a client for target if none is currently running.
+// It is a no-op if a client already exists, which is the common case for a
+// persistent peer being re-dialed by GetClient between reconnects. The
+// concrete transport is chosen by the ClientFactory registered for the
+// peer address's scheme, so this method works the same whether target is
+// reached over gRPC or a message broker.
+func (m *messageRouterImpl) ensureConnected(target NodeID, pc *peerConn) {
+	m.mu.Lock()
+	if _, ok := m.clients[target]; ok {
+		m.mu.Unlock()
+		return
+	}
+	if state, _, _, _ := pc.snapshot(); state == PeerStateFailed {
+		// The peer's retry budget is exhausted, or it failed its
+		// handshake: both are terminal and must never be silently
+		// revived by a later GetClient/Broadcast call.
+		m.mu.Unlock()
+		return
+	}
+	factory, ok := lookupClientFactory(pc.addr.Scheme)
+	if !ok {
+		m.mu.Unlock()
+		log.Warn("failed to create client, no factory for peer address scheme",
+			zap.String("target", target), zap.Stringer("addr", pc.addr))
+		return
+	}
+	client, run := factory.NewClient(m.selfID, target, m.clientConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	m.clients[target] = clientWrapper{MessageClient: client, cancelFn: cancel}
+	m.mu.Unlock()
+
+	pc.setConnecting()
+	m.wg.Add(1)
+	go m.runClient(ctx, cancel, target, pc, run)
+}
+
+// runClient runs a client to completion via run, then drives pc's retry
+// state machine: on failure it schedules a backoff reconnect (unless the
+// peer's retry budget is exhausted), and on cancellation (RemovePeer or
+// Close) it exits without retrying.
+func (m *messageRouterImpl) runClient(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	target NodeID,
+	pc *peerConn,
+	run func(ctx context.Context, addr PeerAddress, credential *security.Credential, local PeerCapabilities, onConnected func(), onHandshake func(PeerCapabilities)) error,
+) {
+	defer m.wg.Done()
+	defer cancel()
+
+	onConnected := func() {
+		pc.setConnected()
+		m.emitEvent(PeerEvent{PeerID: target, Type: PeerEventConnected})
+	}
+	onHandshake := func(caps PeerCapabilities) {
+		m.mu.Lock()
+		m.peerCaps[target] = caps
+		m.mu.Unlock()
+		onConnected()
+	}
+	err := run(ctx, pc.addr, m.credentials, m.capabilities, onConnected, onHandshake)
+	log.Warn("p2p client exited with error",
+		zap.Stringer("addr", pc.addr),
+		zap.String("targetCapture", target),
+		zap.Error(err))
+
+	m.mu.Lock()
+	delete(m.clients, target)
+	delete(m.peerCaps, target)
+	m.mu.Unlock()
+	m.emitEvent(PeerEvent{PeerID: target, Type: PeerEventDisconnected, Err: err})
+
+	if errors.Cause(err) == context.Canceled {
+		// RemovePeer or Close initiated this exit; do not retry.
+		return
+	}
+
+	select {
+	case m.errCh <- err:
+	default:
+		// We allow an error to be lost in case the channel is full.
+	}
+
+	if isHandshakeError(err) {
+		// An incompatible or misconfigured peer: retrying would only
+		// repeat the same failure, so treat it as terminal regardless of
+		// the peer's retry budget.
+		pc.setIncompatible(err)
+		terminalFailureCounter.WithLabelValues(target).Inc()
+		log.Warn("p2p peer failed its handshake, giving up",
+			zap.String("target", target), zap.Error(err))
+		return
+	}
+
+	delay, ok := pc.setBackingOff(err)
+	if !ok {
+		terminalFailureCounter.WithLabelValues(target).Inc()
+		log.Warn("p2p peer exhausted its retry budget, giving up",
+			zap.String("target", target), zap.Error(err))
+		return
+	}
+	reconnectCounter.WithLabelValues(target).Inc()
+	backoffSecondsCounter.WithLabelValues(target).Add(delay.Seconds())
+	m.emitEvent(PeerEvent{PeerID: target, Type: PeerEventBackoff, Err: err})
+
+	select {
+	case <-time.After(delay):
+	case <-pc.stopCh:
+		return
+	}
+	if m.isClosed.Load() {
+		return
+	}
+	m.ensureConnected(target, pc)
+}
+
 func (m *messageRouterImpl) Close() {
 	if m.isClosed.Swap(true) {
 		// the messageRouter is already closed
@@ -207,6 +413,9 @@ func (m *messageRouterImpl) Close() {
 	}
 
 	m.mu.Lock()
+	for _, pc := range m.peers {
+		close(pc.stopCh)
+	}
 	for _, cliWrapper := range m.clients {
 		cliWrapper.cancelFn()
 	}
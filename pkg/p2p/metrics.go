@@ -0,0 +1,49 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	reconnectCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ticdc",
+			Subsystem: "p2p",
+			Name:      "reconnect_total",
+			Help:      "Total number of reconnect attempts made to a peer.",
+		}, []string{"to"})
+
+	backoffSecondsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ticdc",
+			Subsystem: "p2p",
+			Name:      "backoff_seconds_total",
+			Help:      "Total seconds spent backing off before reconnecting to a peer.",
+		}, []string{"to"})
+
+	terminalFailureCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ticdc",
+			Subsystem: "p2p",
+			Name:      "terminal_failure_total",
+			Help:      "Total number of peers given up on because their retry budget was exhausted or their handshake failed.",
+		}, []string{"to"})
+)
+
+// InitMetrics registers metrics owned by the p2p package.
+func InitMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(reconnectCounter)
+	registry.MustRegister(backoffSecondsCounter)
+	registry.MustRegister(terminalFailureCounter)
+}
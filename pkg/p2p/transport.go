@@ -0,0 +1,163 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/pkg/security"
+	"go.uber.org/zap"
+)
+
+// TransportDialer carries the information that a MessageClient needs in
+// order to dial a peer: the gRPC network and target, and, when the
+// transport is secured, the TLS credential to dial with.
+type TransportDialer interface {
+	// Network is the network passed to grpc.Dial's "network" target
+	// resolver, e.g. "tcp" or "unix".
+	Network() string
+	// Target is the dial target, e.g. "host:port" or a filesystem path
+	// for a unix socket.
+	Target() string
+	// Credential returns the TLS credential to dial with, or nil if the
+	// connection should not be secured.
+	Credential() *security.Credential
+}
+
+// transportFactory builds a TransportDialer for a parsed PeerAddress. It is
+// handed the *security.Credential configured on the MessageRouter so that
+// tls/mtls transports can decide whether to honor it.
+type transportFactory func(addr PeerAddress, credential *security.Credential) (TransportDialer, error)
+
+var (
+	transportMu sync.RWMutex
+	transports  = map[string]transportFactory{}
+)
+
+// RegisterTransport registers the dialer factory for a URL scheme. It is
+// expected to be called from package init functions. Registering the same
+// scheme twice is a programming error and panics.
+func RegisterTransport(scheme string, factory transportFactory) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+
+	if _, ok := transports[scheme]; ok {
+		log.Panic("transport already registered", zap.String("scheme", scheme))
+	}
+	transports[scheme] = factory
+}
+
+func lookupTransport(scheme string) (transportFactory, bool) {
+	transportMu.RLock()
+	defer transportMu.RUnlock()
+
+	factory, ok := transports[scheme]
+	return factory, ok
+}
+
+// PeerAddress is a peer address in URL form, e.g. "grpc://host:port",
+// "unix:///var/run/tiflow.sock" or "tls://host:port". The scheme selects
+// the registered ClientFactory used to reach the peer and, for directly
+// dialed schemes, its registered TransportDialer.
+type PeerAddress struct {
+	Scheme string
+	Host   string
+	Path   string
+}
+
+// ParsePeerAddress parses a peer address given in URL form. It returns an
+// error if the address is not a valid URL, or if no ClientFactory is
+// registered for its scheme.
+func ParsePeerAddress(addr string) (PeerAddress, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return PeerAddress{}, errors.Annotatef(err, "invalid peer address %q", addr)
+	}
+	if u.Scheme == "" {
+		return PeerAddress{}, errors.Errorf("peer address %q is missing a scheme", addr)
+	}
+	// A scheme is valid if it has a registered ClientFactory: direct,
+	// TransportDialer-based schemes ("grpc", "unix", "tls", "mtls") all
+	// share the grpcClientFactory, while broker-backed schemes such as
+	// "nats" register only a ClientFactory and no TransportDialer.
+	if !hasClientFactory(u.Scheme) {
+		return PeerAddress{}, errors.Errorf("peer address %q uses unregistered scheme %q", addr, u.Scheme)
+	}
+	return PeerAddress{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   u.Path,
+	}, nil
+}
+
+// Dialer resolves the PeerAddress to a TransportDialer using the registered
+// transport for its scheme.
+func (a PeerAddress) Dialer(credential *security.Credential) (TransportDialer, error) {
+	factory, ok := lookupTransport(a.Scheme)
+	if !ok {
+		return nil, errors.Errorf("no transport registered for scheme %q", a.Scheme)
+	}
+	return factory(a, credential)
+}
+
+func (a PeerAddress) String() string {
+	return a.Scheme + "://" + a.Host + a.Path
+}
+
+type tcpDialer struct {
+	target     string
+	credential *security.Credential
+}
+
+func (d *tcpDialer) Network() string                  { return "tcp" }
+func (d *tcpDialer) Target() string                   { return d.target }
+func (d *tcpDialer) Credential() *security.Credential { return d.credential }
+
+type unixDialer struct {
+	path string
+}
+
+func (d *unixDialer) Network() string                  { return "unix" }
+func (d *unixDialer) Target() string                   { return d.path }
+func (d *unixDialer) Credential() *security.Credential { return nil }
+
+func init() {
+	// "grpc" is the default, unencrypted TCP transport: the historical
+	// bare "host:port" address is equivalent to "grpc://host:port".
+	RegisterTransport("grpc", func(addr PeerAddress, credential *security.Credential) (TransportDialer, error) {
+		return &tcpDialer{target: addr.Host, credential: credential}, nil
+	})
+	RegisterTransport("unix", func(addr PeerAddress, _ *security.Credential) (TransportDialer, error) {
+		return &unixDialer{path: addr.Path}, nil
+	})
+	// "tls" and "mtls" both dial over TCP with the router's configured
+	// credential; "mtls" additionally requires client certificates to be
+	// set on the credential, since the peer will verify them.
+	tlsFactory := func(addr PeerAddress, credential *security.Credential) (TransportDialer, error) {
+		if credential == nil {
+			return nil, errors.Errorf("peer address %q requires a TLS credential but none was configured", addr)
+		}
+		return &tcpDialer{target: addr.Host, credential: credential}, nil
+	}
+	RegisterTransport("tls", tlsFactory)
+	RegisterTransport("mtls", func(addr PeerAddress, credential *security.Credential) (TransportDialer, error) {
+		if credential == nil || !credential.IsTLSEnabled() {
+			return nil, errors.Errorf("peer address %q requires mutual TLS but no client certificate was configured", addr)
+		}
+		return tlsFactory(addr, credential)
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package p2p
+
+import "testing"
+
+func TestParsePeerAddress(t *testing.T) {
+	cases := []struct {
+		name    string
+		addr    string
+		wantErr bool
+		want    PeerAddress
+	}{
+		{
+			name: "grpc scheme",
+			addr: "grpc://127.0.0.1:8301",
+			want: PeerAddress{Scheme: "grpc", Host: "127.0.0.1:8301"},
+		},
+		{
+			name: "unix scheme with path",
+			addr: "unix:///var/run/tiflow.sock",
+			want: PeerAddress{Scheme: "unix", Path: "/var/run/tiflow.sock"},
+		},
+		{
+			name: "tls scheme",
+			addr: "tls://127.0.0.1:8301",
+			want: PeerAddress{Scheme: "tls", Host: "127.0.0.1:8301"},
+		},
+		{
+			name: "nats scheme has no TransportDialer but is still valid",
+			addr: "nats://127.0.0.1:4222/tiflow",
+			want: PeerAddress{Scheme: "nats", Host: "127.0.0.1:4222", Path: "/tiflow"},
+		},
+		{
+			name:    "missing scheme",
+			addr:    "127.0.0.1:8301",
+			wantErr: true,
+		},
+		{
+			name:    "unregistered scheme",
+			addr:    "quic://127.0.0.1:8301",
+			wantErr: true,
+		},
+		{
+			name:    "invalid URL",
+			addr:    "://bad",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePeerAddress(tc.addr)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePeerAddress(%q) = %v, want error", tc.addr, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePeerAddress(%q) returned unexpected error: %v", tc.addr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("ParsePeerAddress(%q) = %+v, want %+v", tc.addr, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePeerAddressUnixDialer(t *testing.T) {
+	addr, err := ParsePeerAddress("unix:///var/run/tiflow.sock")
+	if err != nil {
+		t.Fatalf("ParsePeerAddress failed: %v", err)
+	}
+	dialer, err := addr.Dialer(nil)
+	if err != nil {
+		t.Fatalf("Dialer failed: %v", err)
+	}
+	if got := dialer.Network(); got != "unix" {
+		t.Errorf("Network() = %q, want %q", got, "unix")
+	}
+	if got := dialer.Target(); got != "/var/run/tiflow.sock" {
+		t.Errorf("Target() = %q, want %q", got, "/var/run/tiflow.sock")
+	}
+	if got := dialer.Credential(); got != nil {
+		t.Errorf("Credential() = %v, want nil", got)
+	}
+}